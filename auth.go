@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+var (
+	authMode       = flag.String("auth", "static", "auth backend to use for login tokens: static, jwks, or webhook")
+	authJWKSURL    = flag.String("auth-jwks-url", "", "JWKS URL to fetch verification keys from, required when -auth=jwks")
+	authWebhookURL = flag.String("auth-webhook-url", "", "upstream URL to POST {token, room_id, peer_id} to for an allow/deny decision, required when -auth=webhook")
+
+	// authProvider is the AuthProvider selected by -auth. It is set once in main() before the
+	// HTTP server starts accepting connections.
+	authProvider AuthProvider
+)
+
+// AuthProvider verifies the JWT-bearing login token a peer presents on the websocket and decides
+// whether that peer may join the room it names. Implementations are selected with the -auth flag.
+type AuthProvider interface {
+	// GetKey returns the key and signing method a login token signed with tokenHint must verify
+	// against. It is invoked from the jwt.Keyfunc passed to jwt.ParseWithClaims, so GetKey, not
+	// Authorize, is what rejects an unexpected signing algorithm.
+	GetKey(tokenHint string) (interface{}, jwt.SigningMethod, error)
+	// Authorize runs once tokenString's signature and standard claims have already validated. It
+	// may deny peerId access to roomId outright by returning an error, and it fills in the
+	// capability claims (can_publish, max_bitrate_kbps, role) that capabilitiesFromClaims reads
+	// back out of claims afterwards.
+	Authorize(tokenString string, claims jwt.MapClaims, roomId string, peerId string) error
+}
+
+// newAuthProviderFromFlags builds the AuthProvider selected by -auth.
+func newAuthProviderFromFlags() (AuthProvider, error) {
+	switch *authMode {
+	case "static":
+		return staticKeyAuthProvider{}, nil
+	case "jwks":
+		if *authJWKSURL == "" {
+			return nil, fmt.Errorf("-auth=jwks requires -auth-jwks-url")
+		}
+		return newJWKSAuthProvider(*authJWKSURL), nil
+	case "webhook":
+		if *authWebhookURL == "" {
+			return nil, fmt.Errorf("-auth=webhook requires -auth-webhook-url")
+		}
+		return newWebhookAuthProvider(*authWebhookURL), nil
+	default:
+		return nil, fmt.Errorf("unknown -auth backend: %s", *authMode)
+	}
+}
+
+// viewerRole is the one Role value websocketHandler itself treats specially: regardless of what
+// the can_publish claim says, a viewer never gets a recvonly transceiver added for them. Any other
+// role string is passed through on peerCapabilities purely as metadata for an AuthProvider (e.g.
+// the webhook) to have assigned, without the SFU itself attaching further meaning to it.
+const viewerRole = "viewer"
+
+// peerCapabilities is the set of capability claims an AuthProvider grants a peer for the
+// lifetime of its connection.
+type peerCapabilities struct {
+	CanPublish     bool
+	MaxBitrateKbps int
+	Role           string
+}
+
+// capabilitiesFromClaims reads the capability claims AuthProvider.Authorize settled on back out
+// of claims. A peer defaults to full publish rights if the claim is absent, matching
+// ag-webrtc-sfu's original (pre-AuthProvider) behaviour.
+func capabilitiesFromClaims(claims jwt.MapClaims) peerCapabilities {
+	caps := peerCapabilities{CanPublish: true}
+	if v, ok := claims["can_publish"].(bool); ok {
+		caps.CanPublish = v
+	}
+	if v, ok := claims["max_bitrate_kbps"].(float64); ok {
+		caps.MaxBitrateKbps = int(v)
+	}
+	if v, ok := claims["role"].(string); ok {
+		caps.Role = v
+		if caps.Role == viewerRole {
+			// A viewer is a coarser, belt-and-suspenders denial: even a token that left
+			// can_publish unset, or mistakenly set it true, must never get a publish transceiver.
+			caps.CanPublish = false
+		}
+	}
+	return caps
+}
+
+// staticKeyAuthProvider verifies every token against a single HS256 key read from
+// AG_WEBRTC_SFU_KEY and grants every peer full capabilities. This reproduces ag-webrtc-sfu's
+// original auth behaviour and remains the default.
+type staticKeyAuthProvider struct{}
+
+func (staticKeyAuthProvider) GetKey(tokenHint string) (interface{}, jwt.SigningMethod, error) {
+	return []byte(os.Getenv("AG_WEBRTC_SFU_KEY")), jwt.SigningMethodHS256, nil
+}
+
+func (staticKeyAuthProvider) Authorize(tokenString string, claims jwt.MapClaims, roomId string, peerId string) error {
+	return nil
+}
+
+// jwksCacheTTL bounds how long a jwksAuthProvider trusts the key set it last fetched, so a
+// steady stream of logins doesn't re-fetch it on every token.
+const jwksCacheTTL = 5 * time.Minute
+
+// jwksKey is a single verification key decoded out of a JWKS response, paired with the signing
+// method it is used with.
+type jwksKey struct {
+	key    interface{}
+	method jwt.SigningMethod
+}
+
+// jwksAuthProvider verifies tokens against a JSON Web Key Set fetched from url, selecting a key
+// by the "kid" the client supplies as its token hint.
+type jwksAuthProvider struct {
+	url string
+
+	mu        sync.Mutex
+	fetchedAt time.Time
+	keys      map[string]jwksKey
+}
+
+func newJWKSAuthProvider(url string) *jwksAuthProvider {
+	return &jwksAuthProvider{url: url}
+}
+
+func (p *jwksAuthProvider) GetKey(tokenHint string) (interface{}, jwt.SigningMethod, error) {
+	keys, err := p.keySet()
+	if err != nil {
+		return nil, nil, err
+	}
+	k, ok := keys[tokenHint]
+	if !ok {
+		return nil, nil, fmt.Errorf("no jwks key for kid: %s", tokenHint)
+	}
+	return k.key, k.method, nil
+}
+
+func (*jwksAuthProvider) Authorize(tokenString string, claims jwt.MapClaims, roomId string, peerId string) error {
+	return nil
+}
+
+// keySet returns the provider's cached key set, re-fetching it from url if the cache has expired
+// or hasn't been populated yet.
+func (p *jwksAuthProvider) keySet() (map[string]jwksKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.keys != nil && time.Since(p.fetchedAt) < jwksCacheTTL {
+		return p.keys, nil
+	}
+
+	resp, err := http.Get(p.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("jwks fetch from %s: unexpected status %s", p.url, resp.Status)
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]jwksKey, len(jwks.Keys))
+	for _, k := range jwks.Keys {
+		switch k.Kty {
+		case "RSA":
+			pubKey, err := rsaPublicKeyFromJWK(k.N, k.E)
+			if err != nil {
+				return nil, err
+			}
+			keys[k.Kid] = jwksKey{pubKey, jwt.SigningMethodRS256}
+		case "EC":
+			pubKey, err := ecPublicKeyFromJWK(k.Crv, k.X, k.Y)
+			if err != nil {
+				return nil, err
+			}
+			keys[k.Kid] = jwksKey{pubKey, jwt.SigningMethodES256}
+		default:
+			continue
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("jwks fetch from %s: no usable keys", p.url)
+	}
+
+	p.keys = keys
+	p.fetchedAt = time.Now()
+	return keys, nil
+}
+
+// rsaPublicKeyFromJWK decodes the base64url-encoded modulus and exponent of an RSA JWK.
+func rsaPublicKeyFromJWK(nb64, eb64 string) (*rsa.PublicKey, error) {
+	nBytes, err := base64.RawURLEncoding.DecodeString(nb64)
+	if err != nil {
+		return nil, err
+	}
+	eBytes, err := base64.RawURLEncoding.DecodeString(eb64)
+	if err != nil {
+		return nil, err
+	}
+
+	e := 0
+	for _, b := range eBytes {
+		e = e<<8 | int(b)
+	}
+
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(nBytes), E: e}, nil
+}
+
+// ecPublicKeyFromJWK decodes the base64url-encoded coordinates of an EC JWK. Only the P-256
+// curve (used by ES256, the only EC alg this provider verifies) is supported.
+func ecPublicKeyFromJWK(crv, xb64, yb64 string) (*ecdsa.PublicKey, error) {
+	if crv != "P-256" {
+		return nil, fmt.Errorf("unsupported jwks EC curve: %s", crv)
+	}
+
+	xBytes, err := base64.RawURLEncoding.DecodeString(xb64)
+	if err != nil {
+		return nil, err
+	}
+	yBytes, err := base64.RawURLEncoding.DecodeString(yb64)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(xBytes),
+		Y:     new(big.Int).SetBytes(yBytes),
+	}, nil
+}
+
+// webhookAuthProvider delegates both verification and authorization to an upstream HTTP service:
+// it POSTs {token, room_id, peer_id} to url and trusts the upstream's allow/deny decision. It
+// therefore only accepts unsigned ("none" algorithm) login tokens - they carry the room id but
+// nothing the SFU itself could verify, since trust comes from the webhook call instead.
+type webhookAuthProvider struct {
+	url    string
+	client *http.Client
+}
+
+func newWebhookAuthProvider(url string) *webhookAuthProvider {
+	return &webhookAuthProvider{url: url, client: &http.Client{Timeout: 5 * time.Second}}
+}
+
+func (webhookAuthProvider) GetKey(tokenHint string) (interface{}, jwt.SigningMethod, error) {
+	return jwt.UnsafeAllowNoneSignatureType, jwt.SigningMethodNone, nil
+}
+
+func (p *webhookAuthProvider) Authorize(tokenString string, claims jwt.MapClaims, roomId string, peerId string) error {
+	body, err := json.Marshal(struct {
+		Token  string `json:"token"`
+		RoomId string `json:"room_id"`
+		PeerId string `json:"peer_id"`
+	}{tokenString, roomId, peerId})
+	if err != nil {
+		return err
+	}
+
+	resp, err := p.client.Post(p.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var decision struct {
+		Allow          bool   `json:"allow"`
+		Role           string `json:"role"`
+		CanPublish     *bool  `json:"can_publish"`
+		MaxBitrateKbps int    `json:"max_bitrate_kbps"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&decision); err != nil {
+		return err
+	}
+	if !decision.Allow {
+		return fmt.Errorf("auth webhook denied peer %s access to room %s", peerId, roomId)
+	}
+
+	// tokenString is unsigned, so every claim in it is attacker-controlled. Only the webhook's
+	// decision may grant capabilities - overwrite them here instead of merging, so a token that
+	// smuggles its own can_publish/max_bitrate_kbps claims can't survive an otherwise-allowed
+	// decision that simply omitted them.
+	claims["role"] = decision.Role
+	claims["can_publish"] = decision.CanPublish != nil && *decision.CanPublish
+	delete(claims, "max_bitrate_kbps")
+	if decision.MaxBitrateKbps > 0 {
+		claims["max_bitrate_kbps"] = float64(decision.MaxBitrateKbps)
+	}
+	return nil
+}
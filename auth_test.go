@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// fakeAuthProvider is a minimal AuthProvider for exercising validateTokenAndGetRoomId without a
+// real key backend: it always verifies with a fixed HS256 key and lets the test control whether
+// Authorize allows or denies the peer.
+type fakeAuthProvider struct {
+	key        []byte
+	denyReason error
+}
+
+func (p fakeAuthProvider) GetKey(tokenHint string) (interface{}, jwt.SigningMethod, error) {
+	return p.key, jwt.SigningMethodHS256, nil
+}
+
+func (p fakeAuthProvider) Authorize(tokenString string, claims jwt.MapClaims, roomId string, peerId string) error {
+	return p.denyReason
+}
+
+func signTestToken(t *testing.T, key []byte, claims jwt.MapClaims) string {
+	t.Helper()
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(key)
+	if err != nil {
+		t.Fatalf("failed to sign test token: %v", err)
+	}
+	return signed
+}
+
+func TestValidateTokenAndGetRoomId(t *testing.T) {
+	key := []byte("test-key")
+	provider := fakeAuthProvider{key: key}
+
+	token := signTestToken(t, key, jwt.MapClaims{"sub": "room-1", "can_publish": true})
+	roomId, claims, err := validateTokenAndGetRoomId(token, "", "peer-1", provider)
+	if err != nil {
+		t.Fatalf("validateTokenAndGetRoomId returned unexpected error: %v", err)
+	}
+	if roomId != "room-1" {
+		t.Fatalf("validateTokenAndGetRoomId room id = %q; want room-1", roomId)
+	}
+	if v, _ := claims["can_publish"].(bool); !v {
+		t.Fatalf("validateTokenAndGetRoomId claims = %+v; want can_publish=true", claims)
+	}
+
+	// A token signed with the wrong key must be rejected at the signature-verification step.
+	wrongKeyToken := signTestToken(t, []byte("other-key"), jwt.MapClaims{"sub": "room-1"})
+	if _, _, err := validateTokenAndGetRoomId(wrongKeyToken, "", "peer-1", provider); err == nil {
+		t.Fatal("validateTokenAndGetRoomId with wrong signing key: want error, got nil")
+	}
+
+	// A token missing the sub (room id) claim must be rejected before Authorize is even consulted.
+	noRoomToken := signTestToken(t, key, jwt.MapClaims{})
+	if _, _, err := validateTokenAndGetRoomId(noRoomToken, "", "peer-1", provider); err == nil {
+		t.Fatal("validateTokenAndGetRoomId with missing sub claim: want error, got nil")
+	}
+
+	// Authorize denying the peer must surface as an error even though the signature is valid.
+	denyProvider := fakeAuthProvider{key: key, denyReason: errors.New("not allowed")}
+	if _, _, err := validateTokenAndGetRoomId(token, "", "peer-1", denyProvider); err == nil {
+		t.Fatal("validateTokenAndGetRoomId with Authorize denial: want error, got nil")
+	}
+}
+
+func TestCapabilitiesFromClaimsViewerRoleForcesNoPublish(t *testing.T) {
+	caps := capabilitiesFromClaims(jwt.MapClaims{"role": viewerRole, "can_publish": true})
+	if caps.CanPublish {
+		t.Fatal("capabilitiesFromClaims: a viewer role must force CanPublish false even if can_publish claimed true")
+	}
+	if caps.Role != viewerRole {
+		t.Fatalf("capabilitiesFromClaims Role = %q; want %q", caps.Role, viewerRole)
+	}
+
+	caps = capabilitiesFromClaims(jwt.MapClaims{"role": "moderator"})
+	if !caps.CanPublish {
+		t.Fatal("capabilitiesFromClaims: a non-viewer role must not affect the default CanPublish")
+	}
+}
+
+func TestRsaPublicKeyFromJWK(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate RSA key: %v", err)
+	}
+	nb64 := base64.RawURLEncoding.EncodeToString(key.N.Bytes())
+	eb64 := base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes())
+
+	got, err := rsaPublicKeyFromJWK(nb64, eb64)
+	if err != nil {
+		t.Fatalf("rsaPublicKeyFromJWK returned unexpected error: %v", err)
+	}
+	if got.E != key.E || got.N.Cmp(key.N) != 0 {
+		t.Fatalf("rsaPublicKeyFromJWK = %+v; want N=%v E=%v", got, key.N, key.E)
+	}
+
+	if _, err := rsaPublicKeyFromJWK("not-base64url!!", eb64); err == nil {
+		t.Fatal("rsaPublicKeyFromJWK with invalid n: want error, got nil")
+	}
+	if _, err := rsaPublicKeyFromJWK(nb64, "not-base64url!!"); err == nil {
+		t.Fatal("rsaPublicKeyFromJWK with invalid e: want error, got nil")
+	}
+}
+
+func TestEcPublicKeyFromJWK(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate EC key: %v", err)
+	}
+	xb64 := base64.RawURLEncoding.EncodeToString(key.X.Bytes())
+	yb64 := base64.RawURLEncoding.EncodeToString(key.Y.Bytes())
+
+	got, err := ecPublicKeyFromJWK("P-256", xb64, yb64)
+	if err != nil {
+		t.Fatalf("ecPublicKeyFromJWK returned unexpected error: %v", err)
+	}
+	if got.X.Cmp(key.X) != 0 || got.Y.Cmp(key.Y) != 0 {
+		t.Fatalf("ecPublicKeyFromJWK = %+v; want X=%v Y=%v", got, key.X, key.Y)
+	}
+
+	if _, err := ecPublicKeyFromJWK("P-384", xb64, yb64); err == nil {
+		t.Fatal("ecPublicKeyFromJWK with unsupported curve: want error, got nil")
+	}
+	if _, err := ecPublicKeyFromJWK("P-256", "not-base64url!!", yb64); err == nil {
+		t.Fatal("ecPublicKeyFromJWK with invalid x: want error, got nil")
+	}
+	if _, err := ecPublicKeyFromJWK("P-256", xb64, "not-base64url!!"); err == nil {
+		t.Fatal("ecPublicKeyFromJWK with invalid y: want error, got nil")
+	}
+}
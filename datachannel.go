@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+var (
+	roomChannelRateLimitPerSec = flag.Float64("room-channel-rate-limit", 20,
+		"steady-state messages per second a peer may send on its room data channel, enforced with a token bucket")
+	roomChannelRateBurst = flag.Int("room-channel-rate-burst", 40,
+		"burst size of the room data channel's per-peer token bucket")
+)
+
+// roomChannelMessage is the envelope every message on the "room" data channel is wrapped in.
+// Type is an application-defined string (e.g. "chat", "presence", "raise-hand") - the server only
+// reads it enough to rate-limit and relay, it never validates or interprets it or Payload.
+type roomChannelMessage struct {
+	Type       string          `json:"type"`
+	FromPeerId string          `json:"from_peer_id"`
+	Payload    json.RawMessage `json:"payload"`
+}
+
+// setupRoomDataChannel creates the server-managed "room" data channel on peerId's subscriber
+// connection and wires up fan-out of its messages to every other peer in the room, over SCTP
+// instead of a websocket round trip through the server. The server is always the one that calls
+// CreateDataChannel (the client never does), so there's no need to also listen for
+// OnDataChannel - this is the only "room" channel that will ever exist for this peer.
+func setupRoomDataChannel(room *roomCollection, peerId string, subscriberConnection *webrtc.PeerConnection) (*webrtc.DataChannel, error) {
+	channel, err := subscriberConnection.CreateDataChannel("room", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	limiter := newTokenBucket(*roomChannelRateLimitPerSec, *roomChannelRateBurst)
+
+	channel.OnMessage(func(msg webrtc.DataChannelMessage) {
+		if !limiter.allow() {
+			debugLog("room channel rate limit exceeded for peer: ", peerId, " in room: ", room.id)
+			return
+		}
+
+		var incoming roomChannelMessage
+		if err := json.Unmarshal(msg.Data, &incoming); err != nil {
+			debugLog("invalid room channel message from peer: ", peerId, " error: ", err)
+			return
+		}
+
+		// The sender's own claimed from_peer_id is never trusted - the server is the only party
+		// that knows which peerId this channel actually belongs to.
+		incoming.FromPeerId = peerId
+
+		outgoing, err := json.Marshal(incoming)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		broadcastToOtherPeersOnRoomChannel(room, peerId, outgoing)
+	})
+
+	return channel, nil
+}
+
+// broadcastToOtherPeersOnRoomChannel sends a raw room-channel message to every other peer
+// currently in the room, the same fan-out broadcastToOtherPeersInRoom does over websocket but
+// over each peer's own "room" data channel instead.
+func broadcastToOtherPeersOnRoomChannel(room *roomCollection, fromPeerId string, data []byte) {
+	debugLog("broadcastToOtherPeersOnRoomChannel, fromPeerId: ", fromPeerId)
+	room.listLock.Lock()
+	for _, peerConn := range room.peerConnections {
+		if peerConn.peerId != fromPeerId && peerConn.roomChannel != nil {
+			if err := peerConn.roomChannel.Send(data); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+	room.listLock.Unlock()
+}
+
+// tokenBucket is a simple per-peer rate limiter: it refills at ratePerSec tokens a second up to
+// burst, and allow() only succeeds while there's a token to spend.
+type tokenBucket struct {
+	mu         sync.Mutex
+	ratePerSec float64
+	burst      float64
+	tokens     float64
+	lastRefill time.Time
+}
+
+func newTokenBucket(ratePerSec float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		ratePerSec: ratePerSec,
+		burst:      float64(burst),
+		tokens:     float64(burst),
+		lastRefill: time.Now(),
+	}
+}
+
+func (b *tokenBucket) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if b.tokens += now.Sub(b.lastRefill).Seconds() * b.ratePerSec; b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.lastRefill = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
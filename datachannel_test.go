@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucketAllow(t *testing.T) {
+	t.Run("consumes burst then blocks", func(t *testing.T) {
+		b := newTokenBucket(10, 3)
+		for i := 0; i < 3; i++ {
+			if !b.allow() {
+				t.Fatalf("allow() #%d = false; want true (within burst)", i)
+			}
+		}
+		if b.allow() {
+			t.Fatal("allow() after exhausting burst = true; want false")
+		}
+	})
+
+	t.Run("refills over time up to burst", func(t *testing.T) {
+		b := newTokenBucket(10, 3)
+		b.tokens = 0
+		b.lastRefill = time.Now().Add(-1 * time.Second)
+
+		if !b.allow() {
+			t.Fatal("allow() after a 1s refill at 10/s = false; want true")
+		}
+	})
+
+	t.Run("refill never exceeds burst", func(t *testing.T) {
+		b := newTokenBucket(10, 3)
+		b.lastRefill = time.Now().Add(-1 * time.Hour)
+
+		allowed := 0
+		for i := 0; i < 10; i++ {
+			if b.allow() {
+				allowed++
+			}
+		}
+		if allowed != 3 {
+			t.Fatalf("allowed %d of 10 calls after a long idle period; want exactly burst (3)", allowed)
+		}
+	})
+}
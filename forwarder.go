@@ -0,0 +1,266 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/interceptor/pkg/twcc"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+var (
+	// ccInterceptorFactory drives the GCC/TWCC bandwidth estimator for every PeerConnection.
+	// newPeerConnectionEstimator picks up the estimator it creates for each new connection.
+	ccInterceptorFactory *cc.InterceptorFactory
+	estimatorChan        = make(chan cc.BandwidthEstimator, 1)
+	// newPCLock serialises PeerConnection creation so that the estimator popped off
+	// estimatorChan is always the one that was just created for this connection.
+	newPCLock sync.Mutex
+)
+
+// registerCongestionControl wires up TWCC-based bandwidth estimation for the shared webrtc.API:
+// a header extension interceptor timestamps outgoing packets, a TWCC generator turns received
+// packets into feedback reports, and the cc interceptor turns that feedback into a per-connection
+// bandwidth estimate.
+func registerCongestionControl(m *webrtc.MediaEngine, i *interceptor.Registry) error {
+	m.RegisterFeedback(webrtc.RTCPFeedback{Type: webrtc.TypeRTCPFBTransportCC}, webrtc.RTPCodecTypeVideo)
+	if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: sdp.TransportCCURI}, webrtc.RTPCodecTypeVideo); err != nil {
+		return err
+	}
+
+	headerExtension, err := twcc.NewHeaderExtensionInterceptor()
+	if err != nil {
+		return err
+	}
+	i.Add(headerExtension)
+
+	generator, err := twcc.NewSenderInterceptor()
+	if err != nil {
+		return err
+	}
+	i.Add(generator)
+
+	ccInterceptorFactory, err = cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+		return gcc.NewSendSideBWE()
+	})
+	if err != nil {
+		return err
+	}
+	ccInterceptorFactory.OnNewPeerConnection(func(id string, estimator cc.BandwidthEstimator) {
+		estimatorChan <- estimator
+	})
+	i.Add(ccInterceptorFactory)
+
+	return nil
+}
+
+// newPeerConnectionWithEstimator creates a PeerConnection on the shared mediaAPI and returns the
+// BandwidthEstimator the congestion controller built for it.
+func newPeerConnectionWithEstimator(config webrtc.Configuration) (*webrtc.PeerConnection, cc.BandwidthEstimator, error) {
+	newPCLock.Lock()
+	defer newPCLock.Unlock()
+
+	peerConnection, err := mediaAPI.NewPeerConnection(config)
+	if err != nil {
+		// The cc interceptor's OnNewPeerConnection callback runs synchronously inside Build,
+		// before later steps in NewPeerConnection that can still fail - drain the estimator it
+		// already queued so it doesn't wedge the next caller's receive on estimatorChan.
+		select {
+		case <-estimatorChan:
+		default:
+		}
+		return nil, nil, err
+	}
+
+	return peerConnection, <-estimatorChan, nil
+}
+
+// forwarder tracks the recent throughput of a single forwarded layer (localTrackData) so it can
+// be surfaced via /get.stats?details=true, and is the single write path RTP packets take on
+// their way from a publisher's OnTrack loop to a subscriber's TrackLocalStaticRTP. It also owns
+// that layer's packet cache (see nack.go), which exists to make NACK hit/miss rates observable
+// via stats - actual resends are each subscriber's own nack.ResponderInterceptor's job.
+type forwarder struct {
+	windowStart  int64 // unix nanos, atomically swapped when a window rolls over
+	windowBytes  int64
+	lastRateKbps int64
+
+	cache *packetCache
+}
+
+func newForwarder() *forwarder {
+	return &forwarder{
+		windowStart: time.Now().UnixNano(),
+		cache:       newPacketCache(*nackCacheSize),
+	}
+}
+
+// write forwards a raw RTP packet to trackLocal, records it for the rate calculation, and caches
+// it by sequence number in case a subscriber NACKs it.
+func (f *forwarder) write(trackLocal *webrtc.TrackLocalStaticRTP, b []byte) (int, error) {
+	var pkt rtp.Packet
+	if err := pkt.Unmarshal(b); err == nil {
+		f.cache.put(pkt.SequenceNumber, b)
+	}
+
+	n, err := trackLocal.Write(b)
+	if err == nil {
+		f.record(n)
+	}
+	return n, err
+}
+
+func (f *forwarder) record(n int) {
+	now := time.Now().UnixNano()
+	windowStart := atomic.LoadInt64(&f.windowStart)
+	if elapsed := now - windowStart; elapsed >= int64(time.Second) {
+		bytes := atomic.SwapInt64(&f.windowBytes, 0)
+		atomic.StoreInt64(&f.windowStart, now)
+		atomic.StoreInt64(&f.lastRateKbps, bytes*8/1000)
+	}
+	atomic.AddInt64(&f.windowBytes, int64(n))
+}
+
+// bitrateKbps returns the most recently measured one-second forwarding rate.
+func (f *forwarder) bitrateKbps() int64 {
+	return atomic.LoadInt64(&f.lastRateKbps)
+}
+
+// peerBandwidthStats is the congestion-control state tracked for a single subscriber peer and
+// surfaced via /get.stats?details=true's peers field (see peerStats in main.go). It's updated
+// concurrently from the estimator's OnTargetBitrateChange callback and from RTCP read loops in
+// monitorSubscriberFeedback, one per subscribed stream, so its fields are plain atomics rather
+// than being guarded by room.listLock.
+type peerBandwidthStats struct {
+	estimatedBitrateKbps int64 // atomic
+	// packetLossPermille is the most recently reported receiver-report fraction lost, out of 1000.
+	packetLossPermille int64 // atomic
+}
+
+// peerBandwidthStatsFor returns peerId's peerBandwidthStats, creating it on first use.
+func peerBandwidthStatsFor(room *roomCollection, peerId string) *peerBandwidthStats {
+	room.peerStatsLock.Lock()
+	defer room.peerStatsLock.Unlock()
+	stats, ok := room.peerStats[peerId]
+	if !ok {
+		stats = &peerBandwidthStats{}
+		room.peerStats[peerId] = stats
+	}
+	return stats
+}
+
+// peerBandwidthStatsRow builds the peerStats row for peerId, pairing its tracked estimate and
+// packet loss with sentBitrateKbps (computed by the caller from its current subscriptions, since
+// that isn't state monitorBandwidthEstimate or monitorSubscriberFeedback otherwise tracks).
+func peerBandwidthStatsRow(room *roomCollection, peerId string, sentBitrateKbps int64) peerStats {
+	room.peerStatsLock.RLock()
+	stats, ok := room.peerStats[peerId]
+	room.peerStatsLock.RUnlock()
+
+	row := peerStats{PeerId: peerId, SentBitrateKbps: sentBitrateKbps}
+	if ok {
+		row.EstimatedBitrateKbps = atomic.LoadInt64(&stats.estimatedBitrateKbps)
+		row.PacketLoss = float64(atomic.LoadInt64(&stats.packetLossPermille)) / 1000
+	}
+	return row
+}
+
+// monitorSubscriberFeedback consumes RTCP arriving from a subscriber's RTPSender for the
+// duration of the sender's life. It downgrades the subscriber's simulcast layer on a low REMB
+// estimate (for browsers that don't support TWCC), forwards PLI/FIR requests through to the
+// stream's publisher via room.ssrcToPublisher (since the subscriber has no direct signalling
+// path to the publisher's PeerConnection), and records NACKed sequence numbers against ltd's
+// packet cache for stats - the resend itself is handled by the subscriber's own
+// nack.ResponderInterceptor, not by this function.
+func monitorSubscriberFeedback(room *roomCollection, peerId string, streamId string, sender *webrtc.RTPSender, capabilities peerCapabilities, ltd *localTrackData) {
+	threshold := float32(downgradeThresholdKbps(capabilities))
+	rtcpBuf := make([]byte, 1500)
+	for {
+		n, _, err := sender.Read(rtcpBuf)
+		if err != nil {
+			return
+		}
+
+		packets, err := rtcp.Unmarshal(rtcpBuf[:n])
+		if err != nil {
+			continue
+		}
+
+		for _, pkt := range packets {
+			switch p := pkt.(type) {
+			case *rtcp.ReceiverEstimatedMaximumBitrate:
+				if p.Bitrate/1000 < threshold {
+					downgradeSubscriberLayer(room, peerId, streamId)
+				}
+			case *rtcp.PictureLossIndication:
+				forwardKeyFrameRequestToPublisher(room, webrtc.SSRC(p.MediaSSRC))
+			case *rtcp.FullIntraRequest:
+				for _, entry := range p.FIR {
+					forwardKeyFrameRequestToPublisher(room, webrtc.SSRC(entry.SSRC))
+				}
+			case *rtcp.TransportLayerNack:
+				for i := range p.Nacks {
+					p.Nacks[i].Range(func(seq uint16) bool {
+						recordNackStats(ltd, seq)
+						return true
+					})
+				}
+			case *rtcp.ReceiverReport:
+				stats := peerBandwidthStatsFor(room, peerId)
+				for _, report := range p.Reports {
+					atomic.StoreInt64(&stats.packetLossPermille, int64(report.FractionLost)*1000/256)
+				}
+			}
+		}
+	}
+}
+
+// forwardKeyFrameRequestToPublisher looks up which publisher and simulcast layer own the local
+// SSRC a subscriber just asked for a keyframe on, and relays that request as a PLI on the
+// publisher's PeerConnection, scoped to that layer. Subscribers never have direct signalling
+// access to the publisher.
+func forwardKeyFrameRequestToPublisher(room *roomCollection, ssrc webrtc.SSRC) {
+	room.listLock.RLock()
+	info, ok := room.ssrcToPublisher[ssrc]
+	room.listLock.RUnlock()
+	if !ok {
+		return
+	}
+
+	room.listLock.Lock()
+	requestKeyFrameFromPeerLocked(room, info.peerId, info.rid)
+	room.listLock.Unlock()
+}
+
+// monitorBandwidthEstimate reacts to changes in a subscriber's GCC/TWCC target bitrate by
+// stepping down every simulcast stream it currently subscribes to when the estimate falls below
+// layerDowngradeThresholdKbps. It runs for the lifetime of the estimator's PeerConnection.
+func monitorBandwidthEstimate(room *roomCollection, peerId string, estimator cc.BandwidthEstimator, capabilities peerCapabilities) {
+	threshold := downgradeThresholdKbps(capabilities)
+	stats := peerBandwidthStatsFor(room, peerId)
+	estimator.OnTargetBitrateChange(func(bitrateBps int) {
+		atomic.StoreInt64(&stats.estimatedBitrateKbps, int64(bitrateBps/1000))
+
+		if bitrateBps/1000 >= threshold {
+			return
+		}
+
+		room.listLock.RLock()
+		streamIds := make([]string, 0, len(room.subscriberLayers[peerId]))
+		for streamId := range room.subscriberLayers[peerId] {
+			streamIds = append(streamIds, streamId)
+		}
+		room.listLock.RUnlock()
+
+		for _, streamId := range streamIds {
+			downgradeSubscriberLayer(room, peerId, streamId)
+		}
+	})
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v3"
+)
+
+// newTestSubscriberPeer builds a peerConnectionState with a real subscriberConnection and a
+// websocket wired the same way websocketHandler wires one, so signalPeerConnections can run
+// against it unmodified. The returned func tears everything down.
+func newTestSubscriberPeer(t *testing.T, peerId string) (*peerConnectionState, func()) {
+	t.Helper()
+
+	upgrader := websocket.Upgrader{}
+	var (
+		mu         sync.Mutex
+		serverConn *websocket.Conn
+	)
+	ready := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		mu.Lock()
+		serverConn = conn
+		mu.Unlock()
+		close(ready)
+		// Drain whatever the handler writes (offers) so WriteJSON never blocks on a full buffer.
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http")
+	clientConn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		srv.Close()
+		t.Fatalf("dial: %v", err)
+	}
+	<-ready
+
+	subscriberConnection, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		clientConn.Close()
+		srv.Close()
+		t.Fatalf("NewPeerConnection: %v", err)
+	}
+	// signalPeerConnections' deferred dispatchKeyFrame call walks every peer's
+	// publisherConnection, so it needs to be non-nil even though this test never publishes.
+	publisherConnection, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		subscriberConnection.Close() //nolint
+		clientConn.Close()
+		srv.Close()
+		t.Fatalf("NewPeerConnection: %v", err)
+	}
+
+	mu.Lock()
+	conn := serverConn
+	mu.Unlock()
+
+	pcs := &peerConnectionState{
+		publisherConnection:  publisherConnection,
+		subscriberConnection: subscriberConnection,
+		websocket:            &threadSafeWriter{conn, sync.Mutex{}},
+		peerId:               peerId,
+		HandshakeLock:        &sync.Mutex{},
+	}
+
+	cleanup := func() {
+		publisherConnection.Close() //nolint
+		subscriberConnection.Close() //nolint
+		clientConn.Close()
+		srv.Close()
+	}
+	return pcs, cleanup
+}
+
+// TestSignalPeerConnectionsAcquiresHandshakeLock covers the normal case: a stable subscriber PC
+// with no handshake in flight gets offered and signalOnePeer leaves HandshakeLock held for the
+// "sub-answer" handler to release once the matching answer arrives.
+func TestSignalPeerConnectionsAcquiresHandshakeLock(t *testing.T) {
+	pcs, cleanup := newTestSubscriberPeer(t, "peer-1")
+	defer cleanup()
+
+	room := &roomCollection{
+		trackLocals:      map[string]*localTrackData{},
+		subscriberLayers: map[string]map[string]string{},
+		ssrcToPublisher:  map[webrtc.SSRC]ssrcPublisherInfo{},
+		peerConnections:  []peerConnectionState{*pcs},
+	}
+
+	signalPeerConnections(room)
+
+	if room.peerConnections[0].HandshakeLock.TryLock() {
+		t.Fatal("HandshakeLock was not left held after a successful offer; sub-answer handler would have nothing to release")
+	}
+}
+
+// TestSignalPeerConnectionsQueuesWhileHandshakeInFlight covers the race this request's
+// HandshakeLock was added to fix: a second signal request arriving while a handshake is already
+// in flight must not build a second offer on top of it, and must instead be queued via
+// resignalPending for the "sub-answer" handler to replay.
+func TestSignalPeerConnectionsQueuesWhileHandshakeInFlight(t *testing.T) {
+	pcs, cleanup := newTestSubscriberPeer(t, "peer-1")
+	defer cleanup()
+	pcs.HandshakeLock.Lock() // simulate a handshake already in flight
+
+	room := &roomCollection{
+		trackLocals:      map[string]*localTrackData{},
+		subscriberLayers: map[string]map[string]string{},
+		ssrcToPublisher:  map[webrtc.SSRC]ssrcPublisherInfo{},
+		peerConnections:  []peerConnectionState{*pcs},
+	}
+
+	signalPeerConnections(room)
+
+	if !room.peerConnections[0].resignalPending {
+		t.Fatal("resignalPending was not set when HandshakeLock was already held")
+	}
+	if room.peerConnections[0].subscriberConnection.SignalingState() != webrtc.SignalingStateStable {
+		t.Fatal("signalOnePeer ran anyway and changed signaling state despite the lock already being held")
+	}
+}
+
+// TestSignalPeerConnectionsPrunesClosedPeerState covers that a peer whose subscriberConnection has
+// closed has its ssrcToPublisher and peerStats entries cleaned up when it's spliced out of
+// room.peerConnections, not just when a still-connected peer's wanted-track set changes.
+func TestSignalPeerConnectionsPrunesClosedPeerState(t *testing.T) {
+	pcs, cleanup := newTestSubscriberPeer(t, "peer-1")
+	defer cleanup()
+
+	track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "track-1", "stream-1")
+	if err != nil {
+		t.Fatalf("NewTrackLocalStaticRTP: %v", err)
+	}
+	sender, err := pcs.subscriberConnection.AddTrack(track)
+	if err != nil {
+		t.Fatalf("AddTrack: %v", err)
+	}
+	params := sender.GetParameters()
+	if len(params.Encodings) == 0 {
+		t.Fatal("sender has no encodings to derive an SSRC from")
+	}
+	ssrc := params.Encodings[0].SSRC
+
+	room := &roomCollection{
+		trackLocals:      map[string]*localTrackData{},
+		subscriberLayers: map[string]map[string]string{},
+		ssrcToPublisher:  map[webrtc.SSRC]ssrcPublisherInfo{ssrc: {peerId: "publisher-1", rid: "f"}},
+		peerStats:        map[string]*peerBandwidthStats{"peer-1": {}},
+		peerConnections:  []peerConnectionState{*pcs},
+	}
+
+	if err := pcs.subscriberConnection.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	signalPeerConnections(room)
+
+	if len(room.peerConnections) != 0 {
+		t.Fatal("closed peer was not removed from room.peerConnections")
+	}
+	if _, ok := room.ssrcToPublisher[ssrc]; ok {
+		t.Fatal("ssrcToPublisher entry for the disconnected peer's sender was not pruned")
+	}
+	if _, ok := room.peerStats["peer-1"]; ok {
+		t.Fatal("peerStats entry for the disconnected peer was not pruned")
+	}
+}
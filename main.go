@@ -7,7 +7,6 @@ import (
 	"github.com/golang-jwt/jwt"
 	"log"
 	"net/http"
-	"os"
 	"sync"
 	"time"
 
@@ -17,6 +16,11 @@ import (
 	"github.com/satori/go.uuid"
 )
 
+// maxSignalSyncAttempts caps how many times signalPeerConnections' attemptSync loop will retry a
+// room before giving up for this call and rescheduling - see its use for why an unconditional loop
+// isn't safe.
+const maxSignalSyncAttempts = 25
+
 var (
 	addr      = flag.String("addr", ":9000", "http service address")
 	isDevMode = flag.Bool("dev", false, "is dev mode enabled")
@@ -29,19 +33,48 @@ var (
 	roomCollections     map[string]*roomCollection
 	totalRooms          uint
 	totalPeers          uint
+
+	// mediaAPI is shared by every PeerConnection so all of them negotiate the same codecs,
+	// header extensions and interceptors (see newMediaEngine in simulcast.go).
+	mediaAPI *webrtc.API
 )
 
 type roomCollection struct {
-	// lock for peerConnections and trackLocals
+	// lock for peerConnections, trackLocals, subscriberLayers and ssrcToPublisher
 	id              string
 	listLock        sync.RWMutex
 	peerConnections []peerConnectionState
 	trackLocals     map[string]*localTrackData
+	// subscriberLayers records, per subscriber peer and stream, which simulcast RID that
+	// subscriber is currently receiving. Absent entries fall back to pickDefaultLayer.
+	subscriberLayers map[string]map[string]string
+	// ssrcToPublisher maps the SSRC a subscriber sees for a forwarded track back to the publisher
+	// peer and simulcast layer it came from, so RTCP feedback (PLI/FIR) from a subscriber can be
+	// relayed to the right publisher and layer even though the subscriber has no direct signalling
+	// path to it.
+	ssrcToPublisher map[webrtc.SSRC]ssrcPublisherInfo
+
+	// peerStatsLock guards peerStats. It's separate from listLock because peerStats is updated
+	// from RTCP read loops and the bandwidth estimator's callback (see forwarder.go), which run far
+	// more often than anything else that needs listLock.
+	peerStatsLock sync.RWMutex
+	// peerStats records the most recently observed congestion-control state for each subscriber
+	// peer, surfaced via /get.stats?details=true.
+	peerStats map[string]*peerBandwidthStats
+}
+
+// ssrcPublisherInfo is the value ssrcToPublisher resolves a subscriber-seen SSRC to.
+type ssrcPublisherInfo struct {
+	peerId string
+	rid    string
 }
 
 type localTrackData struct {
 	track        *webrtc.TrackLocalStaticRTP
 	remotePeerId string
+	streamId     string
+	rid          string
+	forwarder    *forwarder
 }
 
 type websocketMessage struct {
@@ -50,20 +83,41 @@ type websocketMessage struct {
 }
 
 type peerConnectionState struct {
-	peerConnection *webrtc.PeerConnection
-	websocket      *threadSafeWriter
-	peerId         string
+	// publisherConnection is recvonly: it is the only place this peer's own published tracks
+	// arrive (see OnTrack in websocketHandler). subscriberConnection is sendonly: it is the only
+	// place forwarded tracks from other peers are sent (see signalPeerConnections). Splitting
+	// them means a subscriber-side renegotiation can never race with this peer's own publish
+	// negotiation, since each has its own signalling state.
+	publisherConnection  *webrtc.PeerConnection
+	subscriberConnection *webrtc.PeerConnection
+	websocket            *threadSafeWriter
+	peerId               string
+	capabilities         peerCapabilities
+
+	// HandshakeLock serialises subscriber-side renegotiation. signalPeerConnections only builds
+	// and sends a new offer once it can acquire this lock; the "sub-answer" websocket case
+	// releases it once subscriberConnection is stable again and replays resignalPending if a
+	// re-signal was requested while the handshake was in flight. This replaces the old fallback
+	// of retrying a fixed number of times and then sleeping 3 seconds before trying the whole
+	// room again.
+	HandshakeLock   *sync.Mutex
+	resignalPending bool
+
+	// roomChannel is this peer's end of the server-managed "room" data channel (see
+	// datachannel.go), used to fan out chat/presence/custom messages without a websocket round
+	// trip through the server's own signalling path.
+	roomChannel *webrtc.DataChannel
 }
 
 func debugLog(v ...interface{}) {
 	if *isDevMode || *isVerbose {
-		log.Println(v)
+		log.Println(v...)
 	}
 }
 
 func verboseLog(v ...interface{}) {
 	if *isVerbose {
-		log.Println(v)
+		log.Println(v...)
 	}
 }
 
@@ -76,6 +130,17 @@ func main() {
 
 	roomCollections = map[string]*roomCollection{}
 
+	var err error
+	mediaAPI, err = newMediaEngine()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	authProvider, err = newAuthProviderFromFlags()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	if *isDevMode {
 		setupDevMode()
 	}
@@ -104,22 +169,80 @@ func main() {
 	log.Fatal(http.ListenAndServe(*addr, nil))
 }
 
+// streamStats reports the forwarding throughput of a single published layer, as measured by its
+// forwarder (see forwarder.go).
+type streamStats struct {
+	RoomId      string `json:"room_id"`
+	PeerId      string `json:"peer_id"`
+	StreamId    string `json:"stream_id"`
+	Rid         string `json:"rid,omitempty"`
+	BitrateKbps int64  `json:"bitrate_kbps"`
+	// NackCacheHits and NackCacheMisses count lookups against this layer's packet cache (see
+	// nack.go), so operators can tell -nack-cache-size is sized well for the traffic it sees.
+	NackCacheHits   uint64 `json:"nack_cache_hits"`
+	NackCacheMisses uint64 `json:"nack_cache_misses"`
+}
+
+// peerStats reports one subscriber peer's congestion-control state: the bandwidth the GCC/TWCC
+// estimator (see forwarder.go) currently targets for it, the rate actually being sent to it across
+// all its subscribed streams, and the most recent packet loss fraction its receiver reports show.
+type peerStats struct {
+	PeerId               string  `json:"peer_id"`
+	EstimatedBitrateKbps int64   `json:"estimated_bitrate_kbps"`
+	SentBitrateKbps      int64   `json:"sent_bitrate_kbps"`
+	PacketLoss           float64 `json:"packet_loss"`
+}
+
 func statsHandler(w http.ResponseWriter, r *http.Request) {
 	stats := struct {
-		TotalRooms uint     `json:"total-rooms"`
-		TotalPeers uint     `json:"total-peers"`
-		RoomIds    []string `json:"room-ids,omitempty"`
-	}{totalRooms, totalPeers, nil}
+		TotalRooms uint          `json:"total-rooms"`
+		TotalPeers uint          `json:"total-peers"`
+		RoomIds    []string      `json:"room-ids,omitempty"`
+		Streams    []streamStats `json:"streams,omitempty"`
+		Peers      []peerStats   `json:"peers,omitempty"`
+	}{totalRooms, totalPeers, nil, nil, nil}
 
 	details, present := r.URL.Query()["details"]
 	if present && len(details) > 0 && details[0] == "true" {
 		roomCollectionsLock.Lock()
 		rooms := make([]string, 0, len(roomCollections))
-		for r := range roomCollections {
-			rooms = append(rooms, r)
+		var streams []streamStats
+		var peers []peerStats
+		for id, room := range roomCollections {
+			rooms = append(rooms, id)
+
+			room.listLock.RLock()
+			for _, ltd := range room.trackLocals {
+				hits, misses := ltd.forwarder.cache.hitsAndMisses()
+				streams = append(streams, streamStats{
+					RoomId:          id,
+					PeerId:          ltd.remotePeerId,
+					StreamId:        ltd.streamId,
+					Rid:             ltd.rid,
+					BitrateKbps:     ltd.forwarder.bitrateKbps(),
+					NackCacheHits:   hits,
+					NackCacheMisses: misses,
+				})
+			}
+			for i := range room.peerConnections {
+				pcs := &room.peerConnections[i]
+				var sentBitrateKbps int64
+				for _, sender := range pcs.subscriberConnection.GetSenders() {
+					if sender.Track() == nil {
+						continue
+					}
+					if ltd, ok := room.trackLocals[sender.Track().ID()]; ok {
+						sentBitrateKbps += ltd.forwarder.bitrateKbps()
+					}
+				}
+				peers = append(peers, peerBandwidthStatsRow(room, pcs.peerId, sentBitrateKbps))
+			}
+			room.listLock.RUnlock()
 		}
 		roomCollectionsLock.Unlock()
 		stats.RoomIds = rooms
+		stats.Streams = streams
+		stats.Peers = peers
 	}
 
 	js, err := json.Marshal(stats)
@@ -138,22 +261,34 @@ func statsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// Add to list of tracks and fire renegotiation for all PeerConnections
-func addTrack(room *roomCollection, t *webrtc.TrackRemote, peerId string) *webrtc.TrackLocalStaticRTP {
+// Add to list of tracks and fire renegotiation for all PeerConnections. For a simulcast
+// publication this is called once per RID, each producing its own TrackLocalStaticRTP so
+// subscribers can independently pick which layer they receive.
+func addTrack(room *roomCollection, t *webrtc.TrackRemote, peerId string) *localTrackData {
 	room.listLock.Lock()
 	defer func() {
 		room.listLock.Unlock()
 		signalPeerConnections(room)
 	}()
 
-	// Create a new TrackLocal with the same codec as our incoming
-	trackLocal, err := webrtc.NewTrackLocalStaticRTP(t.Codec().RTPCodecCapability, t.ID(), t.StreamID())
+	// Create a new TrackLocal with the same codec as our incoming. Its ID folds in the RID so
+	// each simulcast layer of the same publication gets its own TrackLocalStaticRTP and can be
+	// independently added to / removed from a subscriber's PeerConnection.
+	key := trackLocalKey(t.ID(), t.RID())
+	trackLocal, err := webrtc.NewTrackLocalStaticRTP(t.Codec().RTPCodecCapability, key, t.StreamID())
 	if err != nil {
 		panic(err)
 	}
 
-	room.trackLocals[t.ID()] = &localTrackData{trackLocal, peerId}
-	return trackLocal
+	ltd := &localTrackData{
+		track:        trackLocal,
+		remotePeerId: peerId,
+		streamId:     t.StreamID(),
+		rid:          t.RID(),
+		forwarder:    newForwarder(),
+	}
+	room.trackLocals[key] = ltd
+	return ltd
 }
 
 // Remove from list of tracks and fire renegotiation for all PeerConnections
@@ -187,98 +322,40 @@ func signalPeerConnections(room *roomCollection) {
 
 	attemptSync := func() (tryAgain bool) {
 		for i := range room.peerConnections {
-			if room.peerConnections[i].peerConnection.ConnectionState() == webrtc.PeerConnectionStateClosed {
+			pcs := &room.peerConnections[i]
+
+			if pcs.subscriberConnection.ConnectionState() == webrtc.PeerConnectionStateClosed {
+				removePeerState(room, pcs)
 				room.peerConnections = append(room.peerConnections[:i], room.peerConnections[i+1:]...)
 				return true // We modified the slice, start from the beginning
 			}
 
-			// map of sender we already are sending, so we don't double send
-			existingSenders := map[string]bool{}
-
-			for _, sender := range room.peerConnections[i].peerConnection.GetSenders() {
-				if sender.Track() == nil {
-					continue
-				}
-
-				existingSenders[sender.Track().ID()] = true
-
-				// If we have a RTPSender that doesn't map to a existing track remove and signal
-				if _, ok := room.trackLocals[sender.Track().ID()]; !ok {
-					if err := room.peerConnections[i].peerConnection.RemoveTrack(sender); err != nil {
-						return true
-					}
-				}
-			}
-
-			// Don't receive videos we are sending, make sure we don't have loop-back
-			for _, receiver := range room.peerConnections[i].peerConnection.GetReceivers() {
-				if receiver.Track() == nil {
-					continue
-				}
-
-				existingSenders[receiver.Track().ID()] = true
-			}
-
-			// Add all track we aren't sending yet to the PeerConnection
-			for trackID := range room.trackLocals {
-				if _, ok := existingSenders[trackID]; !ok {
-					if _, err := room.peerConnections[i].peerConnection.AddTrack(room.trackLocals[trackID].track); err != nil {
-						return true
-					}
-					debugLog("Added local track to peer: ", room.peerConnections[i].peerId, " in room: ", room.id,
-						" with stream id: ", room.trackLocals[trackID].track.StreamID(),
-						" for remote peer: ", room.trackLocals[trackID].remotePeerId)
-
-					trackMeta, err := json.Marshal(struct {
-						Id     string `json:"id"`
-						PeerId string `json:"peer_id"`
-					}{room.trackLocals[trackID].track.StreamID(), room.trackLocals[trackID].remotePeerId})
-					if err != nil {
-						log.Println(err)
-						return
-					}
-
-					if writeErr := room.peerConnections[i].websocket.WriteJSON(&websocketMessage{
-						Event: "track-meta",
-						Data:  string(trackMeta),
-					}); writeErr != nil {
-						log.Println(writeErr)
-					}
-				}
-			}
-
-			offer, err := room.peerConnections[i].peerConnection.CreateOffer(nil)
-			if err != nil {
-				return true
-			}
-
-			if err = room.peerConnections[i].peerConnection.SetLocalDescription(offer); err != nil {
-				return true
-			}
-
-			offerString, err := json.Marshal(offer)
-			if err != nil {
-				return true
+			// A subscriber offer is already in flight for this peer: don't build a second one on
+			// top of it. Once the matching "sub-answer" arrives the handler releases the lock and
+			// replays this signal via resignalPending, so nothing is lost.
+			if pcs.subscriberConnection.SignalingState() != webrtc.SignalingStateStable || !pcs.HandshakeLock.TryLock() {
+				pcs.resignalPending = true
+				continue
 			}
 
-			verboseLog("Offer: ", offer.SDP, " for peer: ", room.peerConnections[i].peerId)
-			if err = room.peerConnections[i].websocket.WriteJSON(&websocketMessage{
-				Event: "offer",
-				Data:  string(offerString),
-			}); err != nil {
+			if signalOnePeer(room, pcs) {
 				return true
 			}
-			debugLog("Sending offer to peer: ", room.peerConnections[i].peerId, " of room: ", room.id)
 		}
 
 		return
 	}
 
+	// attemptSync returns tryAgain not only when a peer's handshake lock is busy (handled above via
+	// resignalPending) but also whenever a step of signalOnePeer fails - which for a peer stuck in
+	// a bad state (e.g. a dropped TCP connection the read loop hasn't noticed yet, so WriteJSON
+	// keeps erroring) can fail deterministically forever. Cap the retries here instead of spinning
+	// on room.listLock indefinitely; past the cap, release the lock and retry from a fresh
+	// goroutine, the same fallback the fixed-count retry loop this replaced used.
 	for syncAttempt := 0; ; syncAttempt++ {
-		if syncAttempt == 25 {
-			// Release the lock and attempt a sync in 3 seconds. We might be blocking a RemoveTrack or AddTrack
+		if syncAttempt == maxSignalSyncAttempts {
 			go func() {
-				time.Sleep(time.Second * 3)
+				time.Sleep(3 * time.Second)
 				signalPeerConnections(room)
 			}()
 			return
@@ -295,6 +372,141 @@ func signalPeerConnections(room *roomCollection) {
 	}
 }
 
+// removePeerState prunes the per-peer state signalOnePeer doesn't otherwise get a chance to clean
+// up for a peer that is being spliced out of room.peerConnections: the ssrcToPublisher entries for
+// every track its subscriberConnection was still receiving (signalOnePeer only deletes these when
+// a still-connected peer's wanted-track set changes, never on disconnect), and its peerStats entry
+// (see forwarder.go). The caller must already hold room.listLock.
+func removePeerState(room *roomCollection, pcs *peerConnectionState) {
+	for _, sender := range pcs.subscriberConnection.GetSenders() {
+		if params := sender.GetParameters(); len(params.Encodings) > 0 {
+			delete(room.ssrcToPublisher, params.Encodings[0].SSRC)
+		}
+	}
+
+	room.peerStatsLock.Lock()
+	delete(room.peerStats, pcs.peerId)
+	room.peerStatsLock.Unlock()
+}
+
+// signalOnePeer reconciles one peer's subscriberConnection against the streams it should be
+// receiving and, if that adds or removes a track, sends it a fresh offer. The caller must already
+// hold room.listLock and pcs.HandshakeLock; on success the lock is left held for the caller's
+// "sub-answer" handler to release, on any failure it is unlocked here before returning so the
+// caller's retry sees a peer that isn't stuck mid-handshake.
+func signalOnePeer(room *roomCollection, pcs *peerConnectionState) (tryAgain bool) {
+	// Work out, for each published stream, which layer (RID) this peer wants. For non-simulcast
+	// streams there is only ever one candidate layer ("").
+	wantedTrack := selectSubscriberLayers(room, pcs.peerId)
+	wantedTrackIDs := map[string]bool{}
+	for _, trackLocal := range wantedTrack {
+		wantedTrackIDs[trackLocal.track.ID()] = true
+	}
+
+	// map of sender we already are sending, so we don't double send
+	existingSenders := map[string]bool{}
+
+	for _, sender := range pcs.subscriberConnection.GetSenders() {
+		if sender.Track() == nil {
+			continue
+		}
+
+		existingSenders[sender.Track().ID()] = true
+
+		// If this sender's track is no longer one we want to send this peer - either because it
+		// was removed entirely, or because the peer switched simulcast layers - remove and signal.
+		if !wantedTrackIDs[sender.Track().ID()] {
+			if params := sender.GetParameters(); len(params.Encodings) > 0 {
+				delete(room.ssrcToPublisher, params.Encodings[0].SSRC)
+			}
+			if err := pcs.subscriberConnection.RemoveTrack(sender); err != nil {
+				pcs.HandshakeLock.Unlock()
+				return true
+			}
+		}
+	}
+
+	// Add all tracks we aren't sending yet to the PeerConnection
+	for streamId, trackLocal := range wantedTrack {
+		if _, ok := existingSenders[trackLocal.track.ID()]; ok {
+			continue
+		}
+
+		sender, err := pcs.subscriberConnection.AddTrack(trackLocal.track)
+		if err != nil {
+			pcs.HandshakeLock.Unlock()
+			return true
+		}
+		debugLog("Added local track to peer: ", pcs.peerId, " in room: ", room.id,
+			" with stream id: ", streamId, " rid: ", trackLocal.rid,
+			" for remote peer: ", trackLocal.remotePeerId)
+
+		if trackLocal.track.Kind() == webrtc.RTPCodecTypeVideo {
+			// Remember which publisher this forwarded SSRC belongs to so a PLI/FIR the subscriber
+			// sends back can be relayed to the right publisher, and watch the subscriber's
+			// feedback for the lifetime of the sender.
+			if params := sender.GetParameters(); len(params.Encodings) > 0 {
+				room.ssrcToPublisher[params.Encodings[0].SSRC] = ssrcPublisherInfo{peerId: trackLocal.remotePeerId, rid: trackLocal.rid}
+			}
+			go monitorSubscriberFeedback(room, pcs.peerId, streamId, sender, pcs.capabilities, trackLocal)
+		}
+
+		if trackLocal.rid != "" {
+			// Ask the publisher for a fresh keyframe on this layer so the subscriber doesn't have
+			// to wait for the next periodic keyframe to render anything.
+			requestKeyFrameFromPeerLocked(room, trackLocal.remotePeerId, trackLocal.rid)
+		}
+
+		trackMeta, err := json.Marshal(struct {
+			Id     string `json:"id"`
+			PeerId string `json:"peer_id"`
+		}{streamId, trackLocal.remotePeerId})
+		if err != nil {
+			log.Println(err)
+			pcs.HandshakeLock.Unlock()
+			return false
+		}
+
+		if writeErr := pcs.websocket.WriteJSON(&websocketMessage{
+			Event: "track-meta",
+			Data:  string(trackMeta),
+		}); writeErr != nil {
+			log.Println(writeErr)
+		}
+	}
+
+	offer, err := pcs.subscriberConnection.CreateOffer(nil)
+	if err != nil {
+		pcs.HandshakeLock.Unlock()
+		return true
+	}
+
+	if err = pcs.subscriberConnection.SetLocalDescription(offer); err != nil {
+		pcs.HandshakeLock.Unlock()
+		return true
+	}
+
+	offerString, err := json.Marshal(offer)
+	if err != nil {
+		pcs.HandshakeLock.Unlock()
+		return true
+	}
+
+	verboseLog("Offer: ", offer.SDP, " for peer: ", pcs.peerId)
+	if err = pcs.websocket.WriteJSON(&websocketMessage{
+		Event: "sub-offer",
+		Data:  string(offerString),
+	}); err != nil {
+		pcs.HandshakeLock.Unlock()
+		return true
+	}
+	debugLog("Sending sub-offer to peer: ", pcs.peerId, " of room: ", room.id)
+
+	// The offer is now in flight; HandshakeLock stays held until the matching "sub-answer"
+	// releases it in websocketHandler.
+	return false
+}
+
 // dispatchKeyFrame sends a keyframe to all PeerConnections, used everytime a new user joins the call
 func dispatchKeyFrame(room *roomCollection) {
 	room.listLock.Lock()
@@ -302,16 +514,21 @@ func dispatchKeyFrame(room *roomCollection) {
 	//debugLog("dispatchKeyFrame for room: ", room.id)
 
 	for i := range room.peerConnections {
-		for _, receiver := range room.peerConnections[i].peerConnection.GetReceivers() {
-			if receiver.Track() == nil {
-				continue
-			}
+		for _, receiver := range room.peerConnections[i].publisherConnection.GetReceivers() {
+			// Track() returns nil once a receiver has more than one track, which is exactly
+			// the simulcast case (see Tracks() below); use Tracks() so every layer gets its
+			// own PLI instead of silently dropping the refresh for simulcast publishers.
+			for _, track := range receiver.Tracks() {
+				if track == nil {
+					continue
+				}
 
-			_ = room.peerConnections[i].peerConnection.WriteRTCP([]rtcp.Packet{
-				&rtcp.PictureLossIndication{
-					MediaSSRC: uint32(receiver.Track().SSRC()),
-				},
-			})
+				_ = room.peerConnections[i].publisherConnection.WriteRTCP([]rtcp.Packet{
+					&rtcp.PictureLossIndication{
+						MediaSSRC: uint32(track.SSRC()),
+					},
+				})
+			}
 		}
 	}
 }
@@ -367,16 +584,24 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 		log.Println(err)
 		return
 	}
-	roomId, err := validateTokenAndGetRoomId(loginData.Token, loginData.TokenHint, getTokenKey)
+	roomId, claims, err := validateTokenAndGetRoomId(loginData.Token, loginData.TokenHint, peerId, authProvider)
 	if err != nil {
 		log.Println("Provided token: " + loginData.Token)
 		log.Println(err)
 		return
 	}
+	capabilities := capabilitiesFromClaims(claims)
 	roomCollectionsLock.Lock()
 	room, ok := roomCollections[roomId]
 	if !ok {
-		roomCollections[roomId] = &roomCollection{id: roomId, peerConnections: []peerConnectionState{}, trackLocals: map[string]*localTrackData{}}
+		roomCollections[roomId] = &roomCollection{
+			id:               roomId,
+			peerConnections:  []peerConnectionState{},
+			trackLocals:      map[string]*localTrackData{},
+			subscriberLayers: map[string]map[string]string{},
+			ssrcToPublisher:  map[webrtc.SSRC]ssrcPublisherInfo{},
+			peerStats:        map[string]*peerBandwidthStats{},
+		}
 		room, _ = roomCollections[roomId]
 		totalRooms++
 		debugLog("Added new room: ", room.id)
@@ -385,65 +610,113 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	roomCollectionsLock.Unlock()
 
-	// Create new PeerConnection
-	peerConnection, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	// Create the publisher PeerConnection (recvonly: this peer's own published tracks arrive on
+	// it) and the subscriber PeerConnection (sendonly: forwarded tracks from other peers are sent
+	// on it). mediaAPI's congestion-control interceptor queues an estimator for every PC it
+	// builds regardless of direction, so both calls go through newPeerConnectionWithEstimator;
+	// only the subscriber PC's estimate matters, since it is the one sending media to this peer.
+	publisherConnection, _, err := newPeerConnectionWithEstimator(webrtc.Configuration{})
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	defer publisherConnection.Close() //nolint
+
+	subscriberConnection, estimator, err := newPeerConnectionWithEstimator(webrtc.Configuration{})
 	if err != nil {
 		log.Print(err)
 		return
 	}
-	debugLog("New peer connection for room: ", room.id, " with peerId: ", peerId)
+	defer subscriberConnection.Close() //nolint
 
-	// When this frame returns close the PeerConnection
-	defer peerConnection.Close() //nolint
+	debugLog("New peer connections for room: ", room.id, " with peerId: ", peerId)
 
 	defer broadcastToOtherPeersInRoom(room, peerId, &websocketMessage{
 		Event: "peer-gone",
 		Data:  peerId,
 	})
 
-	// Accept one audio and one video track incoming
-	for _, typ := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
-		if _, err := peerConnection.AddTransceiverFromKind(typ, webrtc.RTPTransceiverInit{
-			Direction: webrtc.RTPTransceiverDirectionRecvonly,
-		}); err != nil {
-			log.Print(err)
-			return
+	// Accept one audio and one video track incoming, unless this peer's capabilities say it may
+	// only subscribe.
+	if capabilities.CanPublish {
+		for _, typ := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+			if _, err := publisherConnection.AddTransceiverFromKind(typ, webrtc.RTPTransceiverInit{
+				Direction: webrtc.RTPTransceiverDirectionRecvonly,
+			}); err != nil {
+				log.Print(err)
+				return
+			}
 		}
 	}
 
+	// Server-managed data channel for in-room chat/presence/custom messages (see
+	// datachannel.go). It's created here, before the subscriber PC's first offer goes out below,
+	// so that offer's SDP already carries it instead of needing a second renegotiation.
+	roomChannel, err := setupRoomDataChannel(room, peerId, subscriberConnection)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	pcs := &peerConnectionState{
+		publisherConnection:  publisherConnection,
+		subscriberConnection: subscriberConnection,
+		websocket:            c,
+		peerId:               peerId,
+		capabilities:         capabilities,
+		HandshakeLock:        &sync.Mutex{},
+		roomChannel:          roomChannel,
+	}
+
 	// Add our new PeerConnection to global list
 	room.listLock.Lock()
-	room.peerConnections = append(room.peerConnections, peerConnectionState{peerConnection, c, peerId})
+	room.peerConnections = append(room.peerConnections, *pcs)
 	totalPeers++
 	room.listLock.Unlock()
 
-	// Trickle ICE. Emit server candidate to client
-	peerConnection.OnICECandidate(func(i *webrtc.ICECandidate) {
-		if i == nil {
-			return
-		}
-		debugLog("peerConnection.OnICECandidate for a member of room: ", room.id)
+	monitorBandwidthEstimate(room, peerId, estimator, capabilities)
 
-		candidateString, err := json.Marshal(i.ToJSON())
-		if err != nil {
-			log.Println(err)
-			return
+	// Trickle ICE. Emit server candidates to client, tagged with which PC they belong to so the
+	// client can add them to the matching RTCPeerConnection.
+	onICECandidate := func(event string) func(i *webrtc.ICECandidate) {
+		return func(i *webrtc.ICECandidate) {
+			if i == nil {
+				return
+			}
+			debugLog(event, " for a member of room: ", room.id)
+
+			candidateString, err := json.Marshal(i.ToJSON())
+			if err != nil {
+				log.Println(err)
+				return
+			}
+
+			if writeErr := c.WriteJSON(&websocketMessage{
+				Event: event,
+				Data:  string(candidateString),
+			}); writeErr != nil {
+				log.Println(writeErr)
+			}
 		}
+	}
+	publisherConnection.OnICECandidate(onICECandidate("pub-candidate"))
+	subscriberConnection.OnICECandidate(onICECandidate("sub-candidate"))
 
-		if writeErr := c.WriteJSON(&websocketMessage{
-			Event: "candidate",
-			Data:  string(candidateString),
-		}); writeErr != nil {
-			log.Println(writeErr)
+	publisherConnection.OnConnectionStateChange(func(p webrtc.PeerConnectionState) {
+		debugLog("publisherConnection.OnConnectionStateChange for peer: ", peerId, " of room: ", room.id, " new state: ", p.String())
+		if p == webrtc.PeerConnectionStateFailed {
+			if err := publisherConnection.Close(); err != nil {
+				log.Print(err)
+			}
 		}
 	})
 
-	// If PeerConnection is closed remove it from global list
-	peerConnection.OnConnectionStateChange(func(p webrtc.PeerConnectionState) {
-		debugLog("peerConnection.OnConnectionStateChange for peer: ", peerId, " of room: ", room.id, " new state: ", p.String())
+	// If the subscriber PeerConnection is closed remove the peer from the global list
+	subscriberConnection.OnConnectionStateChange(func(p webrtc.PeerConnectionState) {
+		debugLog("subscriberConnection.OnConnectionStateChange for peer: ", peerId, " of room: ", room.id, " new state: ", p.String())
 		switch p {
 		case webrtc.PeerConnectionStateFailed:
-			if err := peerConnection.Close(); err != nil {
+			if err := subscriberConnection.Close(); err != nil {
 				log.Print(err)
 			}
 		case webrtc.PeerConnectionStateClosed:
@@ -451,11 +724,12 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	})
 
-	peerConnection.OnTrack(func(t *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
-		debugLog("peerConnection.OnTrack for peer: ", peerId, " of room: ", room.id, " with track id: ", t.ID())
+	publisherConnection.OnTrack(func(t *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		debugLog("publisherConnection.OnTrack for peer: ", peerId, " of room: ", room.id, " with track id: ", t.ID(), " rid: ", t.RID())
+
 		// Create a track to fan out our incoming video to all peers
-		trackLocal := addTrack(room, t, peerId)
-		defer removeTrack(room, trackLocal)
+		ltd := addTrack(room, t, peerId)
+		defer removeTrack(room, ltd.track)
 
 		buf := make([]byte, 1500)
 		for {
@@ -464,13 +738,20 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			if _, err = trackLocal.Write(buf[:i]); err != nil {
+			if _, err = ltd.forwarder.write(ltd.track, buf[:i]); err != nil {
 				return
 			}
 		}
 	})
 
-	// Signal for the new PeerConnection
+	// Offer the publisher PC's recvonly transceivers once; it never needs renegotiation again, so
+	// unlike the subscriber PC this doesn't go through signalPeerConnections.
+	if err := sendOffer(publisherConnection, c, "pub-offer", peerId, room.id); err != nil {
+		log.Println(err)
+		return
+	}
+
+	// Signal the subscriber PeerConnection for the new peer
 	signalPeerConnections(room)
 
 	for {
@@ -484,66 +765,134 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		switch message.Event {
-		case "candidate":
+		case "pub-candidate", "sub-candidate":
 			candidate := webrtc.ICECandidateInit{}
 			if err := json.Unmarshal([]byte(message.Data), &candidate); err != nil {
 				log.Println(err)
 				return
 			}
 
-			if err := peerConnection.AddICECandidate(candidate); err != nil {
+			target := publisherConnection
+			if message.Event == "sub-candidate" {
+				target = subscriberConnection
+			}
+			if err := target.AddICECandidate(candidate); err != nil {
+				log.Println(err)
+				return
+			}
+		case "pub-answer":
+			answer := webrtc.SessionDescription{}
+			if err := json.Unmarshal([]byte(message.Data), &answer); err != nil {
+				log.Println(err)
+				return
+			}
+			debugLog("Got pub-answer from peer: ", peerId, " of room: ", roomId)
+			verboseLog("Answer: ", answer.SDP, " from peer: ", peerId)
+
+			if err := publisherConnection.SetRemoteDescription(answer); err != nil {
 				log.Println(err)
 				return
 			}
-		case "answer":
+		case "sub-answer":
 			answer := webrtc.SessionDescription{}
 			if err := json.Unmarshal([]byte(message.Data), &answer); err != nil {
 				log.Println(err)
 				return
 			}
-			debugLog("Got answer from peer: ", peerId, " of room: ", roomId)
+			debugLog("Got sub-answer from peer: ", peerId, " of room: ", roomId)
 			verboseLog("Answer: ", answer.SDP, " from peer: ", peerId)
 
-			if err := peerConnection.SetRemoteDescription(answer); err != nil {
+			if err := subscriberConnection.SetRemoteDescription(answer); err != nil {
+				log.Println(err)
+				return
+			}
+
+			// The handshake this lock was guarding is done; release it and, if another signal
+			// was requested while it was held, replay it now instead of leaving it stale.
+			room.listLock.Lock()
+			resignal := false
+			for i := range room.peerConnections {
+				if room.peerConnections[i].peerId == peerId {
+					room.peerConnections[i].HandshakeLock.Unlock()
+					resignal = room.peerConnections[i].resignalPending
+					room.peerConnections[i].resignalPending = false
+					break
+				}
+			}
+			room.listLock.Unlock()
+			if resignal {
+				signalPeerConnections(room)
+			}
+		case "select-layer":
+			data := selectLayerData{}
+			if err := json.Unmarshal([]byte(message.Data), &data); err != nil {
 				log.Println(err)
 				return
 			}
+			debugLog("select-layer from peer: ", peerId, " stream: ", data.StreamId, " rid: ", data.Rid)
+			selectSubscriberLayer(room, peerId, data.StreamId, data.Rid)
 		}
 	}
 }
 
-func validateTokenAndGetRoomId(tokenString string, tokenHint string, tokenKeyFetcher func(tokenHint string) (string, error)) (string, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &jwt.StandardClaims{}, func(token *jwt.Token) (interface{}, error) {
-		// Don't forget to validate the alg is what you expect:
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
+// sendOffer creates an offer on pc, sets it as the local description, and sends it to the client
+// as event. Used for the publisher PC's one-shot initial offer; the subscriber PC's offers go
+// through signalPeerConnections instead since it renegotiates repeatedly.
+func sendOffer(pc *webrtc.PeerConnection, c *threadSafeWriter, event string, peerId string, roomId string) error {
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+	if err := pc.SetLocalDescription(offer); err != nil {
+		return err
+	}
+
+	offerString, err := json.Marshal(offer)
+	if err != nil {
+		return err
+	}
+
+	verboseLog("Offer: ", offer.SDP, " for peer: ", peerId)
+	if err := c.WriteJSON(&websocketMessage{Event: event, Data: string(offerString)}); err != nil {
+		return err
+	}
+	debugLog("Sending ", event, " to peer: ", peerId, " of room: ", roomId)
+	return nil
+}
 
-		var key string
-		var err error
-		if key, err = tokenKeyFetcher(tokenHint); err != nil {
+// validateTokenAndGetRoomId verifies tokenString against provider, authorizes peerId for the
+// room it names, and returns that room id along with the capability claims (can_publish,
+// max_bitrate_kbps, role) the peer was granted.
+func validateTokenAndGetRoomId(tokenString string, tokenHint string, peerId string, provider AuthProvider) (string, jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		key, method, err := provider.GetKey(tokenHint)
+		if err != nil {
 			return nil, err
 		}
-
-		return []byte(key), nil
+		// Don't forget to validate the alg is what you expect:
+		if token.Method.Alg() != method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return key, nil
 	})
-
 	if err != nil {
-		return "", err
+		return "", nil, err
+	}
+	if !token.Valid {
+		return "", nil, fmt.Errorf("invalid token: %+v", token)
 	}
 
-	if claims, ok := token.Claims.(*jwt.StandardClaims); ok && token.Valid {
-		if err := claims.Valid(); err != nil {
-			return "", err
-		}
-		return claims.Subject, nil
-	} else {
-		return "", fmt.Errorf("invalid token: %+v", token)
+	roomId, _ := claims["sub"].(string)
+	if roomId == "" {
+		return "", nil, fmt.Errorf("token is missing a room id (sub claim)")
+	}
+
+	if err := provider.Authorize(tokenString, claims, roomId, peerId); err != nil {
+		return "", nil, err
 	}
-}
 
-func getTokenKey(tokenHint string) (string, error) {
-	return os.Getenv("AG_WEBRTC_SFU_KEY"), nil
+	return roomId, claims, nil
 }
 
 // Helper to make Gorilla Websockets thread-safe
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"flag"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/nack"
+	"github.com/pion/webrtc/v3"
+)
+
+var nackCacheSize = flag.Int("nack-cache-size", 512,
+	"number of recent RTP packets to keep per published layer. Drives both the size of pion's "+
+		"per-subscriber nack.ResponderInterceptor send buffer (rounded up to the nearest power of "+
+		"two it accepts, see responderCacheSize) - which bounds how far back a NACK can actually be "+
+		"recovered from - and this package's own hit/miss counters surfaced in "+
+		"/get.stats?details=true")
+
+// responderCacheSize rounds n up to the nearest power of two nack.ResponderSize accepts (1 to
+// 32768), since pion's send buffer is a ring indexed by sequence number bitmask and requires one.
+func responderCacheSize(n int) uint16 {
+	if n <= 1 {
+		return 1
+	}
+	if n >= 32768 {
+		return 32768
+	}
+	size := uint16(1)
+	for int(size) < n {
+		size <<= 1
+	}
+	return size
+}
+
+// configureNack wires up NACK generation and response the same way
+// webrtc.RegisterDefaultInterceptors' ConfigureNack does, except the responder's send buffer is
+// sized from cacheSize instead of pion's hardcoded default of 1024, so -nack-cache-size actually
+// tunes how many lost packets can be recovered, not just the stats counters below.
+func configureNack(m *webrtc.MediaEngine, i *interceptor.Registry, cacheSize int) error {
+	generator, err := nack.NewGeneratorInterceptor()
+	if err != nil {
+		return err
+	}
+
+	responder, err := nack.NewResponderInterceptor(nack.ResponderSize(responderCacheSize(cacheSize)))
+	if err != nil {
+		return err
+	}
+
+	m.RegisterFeedback(webrtc.RTCPFeedback{Type: "nack"}, webrtc.RTPCodecTypeVideo)
+	m.RegisterFeedback(webrtc.RTCPFeedback{Type: "nack", Parameter: "pli"}, webrtc.RTPCodecTypeVideo)
+	i.Add(responder)
+	i.Add(generator)
+	return nil
+}
+
+// packetCache is a ring buffer of the most recently forwarded RTP packets for one published
+// layer (localTrackData), keyed by sequence number. It is populated once per packet in the
+// OnTrack read loop. Actual NACK resends are handled entirely by each subscriber's own
+// nack.ResponderInterceptor (registered per-sender by configureNack in newMediaEngine), which
+// keeps its own per-subscriber send buffer - this cache can't safely take over that job itself,
+// since ltd.track is a single TrackLocalStaticRTP shared by every subscriber of this layer and
+// writing to it fans a resend out to all of them, not just the one that NACKed. Instead this cache
+// exists purely to make hit/miss rates observable via stats (see recordNackStats below). A single
+// mutex guards it rather than anything more elaborate - put/get are a slice index and a short
+// copy, so it never holds the hot forwarding path for long.
+type packetCache struct {
+	mu      sync.Mutex
+	packets [][]byte
+	seqs    []uint16
+	filled  []bool
+
+	hits   uint64
+	misses uint64
+}
+
+func newPacketCache(size int) *packetCache {
+	return &packetCache{
+		packets: make([][]byte, size),
+		seqs:    make([]uint16, size),
+		filled:  make([]bool, size),
+	}
+}
+
+// put records a copy of a just-forwarded RTP packet under its sequence number.
+func (c *packetCache) put(seq uint16, b []byte) {
+	cp := make([]byte, len(b))
+	copy(cp, b)
+
+	slot := int(seq) % len(c.packets)
+	c.mu.Lock()
+	c.packets[slot] = cp
+	c.seqs[slot] = seq
+	c.filled[slot] = true
+	c.mu.Unlock()
+}
+
+// get returns the cached packet for seq, if the ring buffer hasn't since wrapped over it.
+func (c *packetCache) get(seq uint16) ([]byte, bool) {
+	slot := int(seq) % len(c.packets)
+
+	c.mu.Lock()
+	found := c.filled[slot] && c.seqs[slot] == seq
+	var b []byte
+	if found {
+		b = c.packets[slot]
+	}
+	c.mu.Unlock()
+
+	if found {
+		atomic.AddUint64(&c.hits, 1)
+	} else {
+		atomic.AddUint64(&c.misses, 1)
+	}
+	return b, found
+}
+
+// hitsAndMisses reports the cache's lifetime hit/miss counts, for /get.stats?details=true.
+func (c *packetCache) hitsAndMisses() (hits uint64, misses uint64) {
+	return atomic.LoadUint64(&c.hits), atomic.LoadUint64(&c.misses)
+}
+
+// recordNackStats looks up a single NACKed sequence number in ltd's packet cache purely to keep
+// its hit/miss counters (surfaced via /get.stats?details=true) accurate. The actual resend for
+// this NACK is left entirely to the subscriber's own nack.ResponderInterceptor - see the
+// packetCache doc comment for why this cache must not also write the packet itself.
+func recordNackStats(ltd *localTrackData, seq uint16) {
+	ltd.forwarder.cache.get(seq)
+}
@@ -0,0 +1,79 @@
+package main
+
+import "testing"
+
+func TestPacketCachePutGet(t *testing.T) {
+	c := newPacketCache(4)
+
+	if _, ok := c.get(1); ok {
+		t.Fatal("get on empty cache = ok; want miss")
+	}
+
+	c.put(1, []byte("seq1"))
+	got, ok := c.get(1)
+	if !ok || string(got) != "seq1" {
+		t.Fatalf("get(1) = %q, %v; want \"seq1\", true", got, ok)
+	}
+
+	hits, misses := c.hitsAndMisses()
+	if hits != 1 || misses != 1 {
+		t.Fatalf("hitsAndMisses() = %d, %d; want 1, 1", hits, misses)
+	}
+}
+
+func TestPacketCacheWraparound(t *testing.T) {
+	c := newPacketCache(4)
+
+	// Sequence numbers 1 and 5 collide on the same slot (size 4). Writing 5 after 1 should evict
+	// 1's slot, so a later get(1) must miss instead of returning stale data for the wrong seq.
+	c.put(1, []byte("seq1"))
+	c.put(5, []byte("seq5"))
+
+	if _, ok := c.get(1); ok {
+		t.Fatal("get(1) after slot was overwritten by seq 5 = ok; want miss (stale slot)")
+	}
+
+	got, ok := c.get(5)
+	if !ok || string(got) != "seq5" {
+		t.Fatalf("get(5) = %q, %v; want \"seq5\", true", got, ok)
+	}
+}
+
+func TestResponderCacheSize(t *testing.T) {
+	cases := []struct {
+		n    int
+		want uint16
+	}{
+		{n: 0, want: 1},
+		{n: 1, want: 1},
+		{n: 2, want: 2},
+		{n: 3, want: 4},
+		{n: 512, want: 512},
+		{n: 513, want: 1024},
+		{n: 32768, want: 32768},
+		{n: 40000, want: 32768},
+	}
+	for _, c := range cases {
+		if got := responderCacheSize(c.n); got != c.want {
+			t.Errorf("responderCacheSize(%d) = %d; want %d", c.n, got, c.want)
+		}
+	}
+}
+
+func TestPacketCacheSequenceNumberWraparound(t *testing.T) {
+	c := newPacketCache(4)
+
+	// uint16 sequence numbers themselves wrap from 65535 back to 0; put/get must still index
+	// correctly around that edge.
+	c.put(65535, []byte("last"))
+	c.put(0, []byte("first"))
+
+	got, ok := c.get(65535)
+	if !ok || string(got) != "last" {
+		t.Fatalf("get(65535) = %q, %v; want \"last\", true", got, ok)
+	}
+	got, ok = c.get(0)
+	if !ok || string(got) != "first" {
+		t.Fatalf("get(0) = %q, %v; want \"first\", true", got, ok)
+	}
+}
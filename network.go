@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
+
+var (
+	publicIP     = flag.String("public-ip", "", "public IP address to advertise as a 1:1 NAT mapping for host ICE candidates, for an SFU deployed behind a NAT or load balancer")
+	udpMuxPort   = flag.Int("udp-mux-port", 0, "single UDP port every PeerConnection's media is muxed onto; 0 lets each connection pick its own ephemeral port instead")
+	tcpMuxPort   = flag.Int("tcp-mux-port", 0, "TCP port ICE-TCP candidates are muxed onto, for networks that block UDP; 0 disables ICE over TCP")
+	icePortRange = flag.String("ice-port-range", "", "min-max ephemeral UDP port range for ICE agents, e.g. 50000-50100; ignored when -udp-mux-port is set")
+)
+
+// newSettingEngine builds the webrtc.SettingEngine shared by every PeerConnection, wiring up
+// whatever NAT and port configuration was requested on the command line so the SFU can be
+// reached from behind a NAT and, where the client's network blocks UDP, over ICE-TCP.
+func newSettingEngine() (webrtc.SettingEngine, error) {
+	var s webrtc.SettingEngine
+
+	if *publicIP != "" {
+		s.SetNAT1To1IPs([]string{*publicIP}, webrtc.ICECandidateTypeHost)
+	}
+
+	networkTypes := []webrtc.NetworkType{webrtc.NetworkTypeUDP4, webrtc.NetworkTypeUDP6}
+
+	if *udpMuxPort != 0 {
+		udpConn, err := net.ListenUDP("udp", &net.UDPAddr{Port: *udpMuxPort})
+		if err != nil {
+			return s, fmt.Errorf("ice udp mux: %w", err)
+		}
+		s.SetICEUDPMux(webrtc.NewICEUDPMux(nil, udpConn))
+		log.Printf("ICE UDP mux listening on %s", udpConn.LocalAddr())
+	} else if *icePortRange != "" {
+		portMin, portMax, err := parsePortRange(*icePortRange)
+		if err != nil {
+			return s, fmt.Errorf("ice-port-range: %w", err)
+		}
+		if err := s.SetEphemeralUDPPortRange(portMin, portMax); err != nil {
+			return s, fmt.Errorf("ice-port-range: %w", err)
+		}
+	}
+
+	if *tcpMuxPort != 0 {
+		tcpListener, err := net.ListenTCP("tcp", &net.TCPAddr{Port: *tcpMuxPort})
+		if err != nil {
+			return s, fmt.Errorf("ice tcp mux: %w", err)
+		}
+		// readBufferSize is how many packets a single ICE-TCP connection may have queued between
+		// the mux's read loop and the consumer before it starts applying backpressure; pion/ice
+		// itself only uses single digits in its tests, which is too easy to fill during a burst
+		// (e.g. a keyframe spanning several RTP packets) and would stall that peer's connection.
+		s.SetICETCPMux(webrtc.NewICETCPMux(nil, tcpListener, 256))
+		networkTypes = append(networkTypes, webrtc.NetworkTypeTCP4, webrtc.NetworkTypeTCP6)
+		log.Printf("ICE TCP mux listening on %s", tcpListener.Addr())
+	}
+
+	s.SetNetworkTypes(networkTypes)
+
+	return s, nil
+}
+
+// parsePortRange parses a "min-max" UDP port range as accepted by -ice-port-range.
+func parsePortRange(s string) (uint16, uint16, error) {
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("expected min-max, got %q", s)
+	}
+
+	portMin, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid min port %q: %w", parts[0], err)
+	}
+	portMax, err := strconv.ParseUint(parts[1], 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid max port %q: %w", parts[1], err)
+	}
+
+	return uint16(portMin), uint16(portMax), nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		wantMin uint16
+		wantMax uint16
+		wantErr bool
+	}{
+		{name: "valid range", in: "50000-50100", wantMin: 50000, wantMax: 50100},
+		{name: "single port range", in: "5000-5000", wantMin: 5000, wantMax: 5000},
+		{name: "missing dash", in: "50000", wantErr: true},
+		{name: "too many parts", in: "1-2-3", wantErr: true},
+		{name: "non-numeric min", in: "abc-50100", wantErr: true},
+		{name: "non-numeric max", in: "50000-abc", wantErr: true},
+		{name: "port out of uint16 range", in: "50000-99999", wantErr: true},
+		{name: "empty string", in: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotMin, gotMax, err := parsePortRange(tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parsePortRange(%q) = %d, %d, nil; want error", tt.in, gotMin, gotMax)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parsePortRange(%q) returned unexpected error: %v", tt.in, err)
+			}
+			if gotMin != tt.wantMin || gotMax != tt.wantMax {
+				t.Fatalf("parsePortRange(%q) = %d, %d; want %d, %d", tt.in, gotMin, gotMax, tt.wantMin, tt.wantMax)
+			}
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+var (
+	layerDowngradeThresholdKbps = flag.Int("layer-downgrade-threshold-kbps", 300,
+		"estimated subscriber bitrate (from REMB/TWCC), below which the SFU will switch that subscriber down to a lower simulcast layer")
+
+	// simulcastLayerPriority lists the RIDs a publisher can advertise, ordered from highest to
+	// lowest quality. It is used both to pick a sane default layer for new subscribers and to
+	// step down one layer at a time when a subscriber's bandwidth estimate degrades.
+	simulcastLayerPriority = []string{"f", "h", "q"}
+)
+
+// newMediaEngine builds the webrtc.API used for every PeerConnection. It registers the default
+// codecs plus the header extensions required for the browser to signal simulcast RIDs, and wires
+// up Pion's default interceptors (NACK, RTCP reports, etc.) on top of them.
+func newMediaEngine() (*webrtc.API, error) {
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterDefaultCodecs(); err != nil {
+		return nil, err
+	}
+
+	for _, extension := range []string{
+		"urn:ietf:params:rtp-hdrext:sdes:mid",
+		"urn:ietf:params:rtp-hdrext:sdes:rtp-stream-id",
+		"urn:ietf:params:rtp-hdrext:sdes:repaired-rtp-stream-id",
+	} {
+		if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: extension}, webrtc.RTPCodecTypeVideo); err != nil {
+			return nil, err
+		}
+	}
+
+	i := &interceptor.Registry{}
+	if err := registerCongestionControl(m, i); err != nil {
+		return nil, err
+	}
+
+	// Wire up NACK and RTCP sender/receiver reports the same way webrtc.RegisterDefaultInterceptors
+	// would, but skip its ConfigureTWCCSender: registerCongestionControl already registered the TWCC
+	// header extension and its own twcc.NewSenderInterceptor for the GCC estimator, and
+	// RegisterDefaultInterceptors would add a second, independent TWCC sender generating its own
+	// duplicate RTCP feedback over the same incoming RTP. configureNack additionally sizes the
+	// responder's send buffer from -nack-cache-size instead of pion's hardcoded default.
+	if err := configureNack(m, i, *nackCacheSize); err != nil {
+		return nil, err
+	}
+	if err := webrtc.ConfigureRTCPReports(i); err != nil {
+		return nil, err
+	}
+
+	s, err := newSettingEngine()
+	if err != nil {
+		return nil, err
+	}
+
+	return webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i), webrtc.WithSettingEngine(s)), nil
+}
+
+// trackLocalKey derives the key a simulcast-aware track is stored under in room.trackLocals.
+// streamId is the remote track's StreamID, which Pion keeps identical across all RIDs of the
+// same simulcast publication. Non-simulcast tracks (rid == "") keep using the plain stream ID so
+// existing behaviour for audio, screenshare, etc. is unaffected.
+func trackLocalKey(streamId, rid string) string {
+	if rid == "" {
+		return streamId
+	}
+	return streamId + "|" + rid
+}
+
+// lowerSimulcastLayer returns the next lower quality RID after current, or "" if current is
+// already the lowest known layer (or not a recognised layer at all).
+func lowerSimulcastLayer(current string) string {
+	for i, rid := range simulcastLayerPriority {
+		if rid == current && i+1 < len(simulcastLayerPriority) {
+			return simulcastLayerPriority[i+1]
+		}
+	}
+	return ""
+}
+
+// pickDefaultLayer chooses the layer a new subscriber starts on out of the set of RIDs a
+// publisher currently has available for a stream, preferring the highest quality layer.
+func pickDefaultLayer(availableRids map[string]bool) string {
+	for _, rid := range simulcastLayerPriority {
+		if availableRids[rid] {
+			return rid
+		}
+	}
+	for rid := range availableRids {
+		return rid
+	}
+	return ""
+}
+
+// downgradeThresholdKbps returns the bitrate, in kbps, below which a subscriber with these
+// capabilities should downgrade a layer: its own max_bitrate_kbps claim if its AuthProvider set
+// one, otherwise the -layer-downgrade-threshold-kbps default.
+func downgradeThresholdKbps(capabilities peerCapabilities) int {
+	if capabilities.MaxBitrateKbps > 0 {
+		return capabilities.MaxBitrateKbps
+	}
+	return *layerDowngradeThresholdKbps
+}
+
+// downgradeSubscriberLayer moves a subscriber's selected layer for streamId one step down, if a
+// lower layer is still available.
+func downgradeSubscriberLayer(room *roomCollection, peerId string, streamId string) {
+	room.listLock.RLock()
+	current := room.subscriberLayers[peerId][streamId]
+	next := lowerSimulcastLayer(current)
+	room.listLock.RUnlock()
+
+	if next == "" || next == current {
+		return
+	}
+
+	debugLog("Downgrading peer: ", peerId, " to layer: ", next, " for stream: ", streamId, " in room: ", room.id)
+	selectSubscriberLayer(room, peerId, streamId, next)
+}
+
+// selectSubscriberLayer records which RID a subscriber wants for a given published stream and
+// re-syncs the room so the switch takes effect. An unknown or empty rid is ignored.
+func selectSubscriberLayer(room *roomCollection, peerId string, streamId string, rid string) {
+	room.listLock.Lock()
+	found := false
+	for _, ltd := range room.trackLocals {
+		if ltd.streamId == streamId && ltd.rid == rid {
+			found = true
+			break
+		}
+	}
+	if !found {
+		room.listLock.Unlock()
+		return
+	}
+	if room.subscriberLayers[peerId] == nil {
+		room.subscriberLayers[peerId] = map[string]string{}
+	}
+	room.subscriberLayers[peerId][streamId] = rid
+	room.listLock.Unlock()
+
+	signalPeerConnections(room)
+}
+
+// selectSubscriberLayers groups room.trackLocals by published stream and picks, for each one,
+// the single layer a given subscriber should receive, seeding room.subscriberLayers with any
+// default it resolves so later downgrades have a real "current" layer to step down from. The
+// caller must already hold room.listLock (for writing).
+func selectSubscriberLayers(room *roomCollection, peerId string) map[string]*localTrackData {
+	byStream := map[string]map[string]*localTrackData{}
+	for _, ltd := range room.trackLocals {
+		if byStream[ltd.streamId] == nil {
+			byStream[ltd.streamId] = map[string]*localTrackData{}
+		}
+		byStream[ltd.streamId][ltd.rid] = ltd
+	}
+
+	wanted := make(map[string]*localTrackData, len(byStream))
+	for streamId, layers := range byStream {
+		if len(layers) == 1 {
+			for _, ltd := range layers {
+				wanted[streamId] = ltd
+			}
+			continue
+		}
+
+		available := make(map[string]bool, len(layers))
+		for rid := range layers {
+			available[rid] = true
+		}
+
+		rid := room.subscriberLayers[peerId][streamId]
+		if !available[rid] {
+			rid = pickDefaultLayer(available)
+			// Seed the map with the layer we actually resolved, so a later downgrade (REMB/TWCC)
+			// has a real "current" to step down from instead of silently no-op'ing against an
+			// absent entry.
+			if room.subscriberLayers[peerId] == nil {
+				room.subscriberLayers[peerId] = map[string]string{}
+			}
+			room.subscriberLayers[peerId][streamId] = rid
+		}
+		wanted[streamId] = layers[rid]
+	}
+	return wanted
+}
+
+// requestKeyFrameFromPeerLocked sends a PLI to peerId's publisherConnection for the given
+// simulcast layer (rid), or to every video receiver if rid is "" (the non-simulcast case, where a
+// receiver only ever has one track). The caller must already hold room.listLock.
+func requestKeyFrameFromPeerLocked(room *roomCollection, peerId string, rid string) {
+	for i := range room.peerConnections {
+		if room.peerConnections[i].peerId != peerId {
+			continue
+		}
+		for _, receiver := range room.peerConnections[i].publisherConnection.GetReceivers() {
+			for _, track := range receiver.Tracks() {
+				if track == nil || (rid != "" && track.RID() != rid) {
+					continue
+				}
+				_ = room.peerConnections[i].publisherConnection.WriteRTCP([]rtcp.Packet{
+					&rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())},
+				})
+			}
+		}
+		return
+	}
+}
+
+// selectLayerData is the payload of a "select-layer" websocket event, through which a subscriber
+// asks the SFU to switch one of its incoming simulcast streams to a different RID.
+type selectLayerData struct {
+	StreamId string `json:"stream_id"`
+	Rid      string `json:"rid"`
+}
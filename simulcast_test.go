@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestPickDefaultLayer(t *testing.T) {
+	if got := pickDefaultLayer(map[string]bool{"q": true, "h": true, "f": true}); got != "f" {
+		t.Fatalf("pickDefaultLayer = %q; want highest-priority layer f", got)
+	}
+	if got := pickDefaultLayer(map[string]bool{"q": true, "h": true}); got != "h" {
+		t.Fatalf("pickDefaultLayer = %q; want h when f is unavailable", got)
+	}
+	if got := pickDefaultLayer(map[string]bool{"unknown-rid": true}); got != "unknown-rid" {
+		t.Fatalf("pickDefaultLayer = %q; want the sole unrecognised rid as a fallback", got)
+	}
+	if got := pickDefaultLayer(map[string]bool{}); got != "" {
+		t.Fatalf("pickDefaultLayer = %q; want empty string for no available layers", got)
+	}
+}
+
+func newTestTrackLocalData(t *testing.T, streamId, rid string) *localTrackData {
+	t.Helper()
+	track, err := webrtc.NewTrackLocalStaticRTP(
+		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8},
+		trackLocalKey(streamId, rid),
+		streamId,
+	)
+	if err != nil {
+		t.Fatalf("NewTrackLocalStaticRTP: %v", err)
+	}
+	return &localTrackData{track: track, streamId: streamId, rid: rid, forwarder: newForwarder()}
+}
+
+// TestSelectSubscriberLayersSeedsDefault covers the bug the downgrade path depends on: a
+// subscriber's first selectSubscriberLayers call must seed room.subscriberLayers with the layer
+// it actually resolved, not leave it absent, or a later bandwidth-based downgrade has no "current"
+// layer to step down from and is a silent no-op.
+func TestSelectSubscriberLayersSeedsDefault(t *testing.T) {
+	room := &roomCollection{
+		trackLocals: map[string]*localTrackData{
+			trackLocalKey("stream-1", "f"): newTestTrackLocalData(t, "stream-1", "f"),
+			trackLocalKey("stream-1", "h"): newTestTrackLocalData(t, "stream-1", "h"),
+			trackLocalKey("stream-1", "q"): newTestTrackLocalData(t, "stream-1", "q"),
+		},
+		subscriberLayers: map[string]map[string]string{},
+	}
+
+	wanted := selectSubscriberLayers(room, "peer-1")
+
+	ltd, ok := wanted["stream-1"]
+	if !ok || ltd.rid != "f" {
+		t.Fatalf("selectSubscriberLayers picked rid %q for a fresh subscriber; want the highest quality layer f", ltd.rid)
+	}
+	if got := room.subscriberLayers["peer-1"]["stream-1"]; got != "f" {
+		t.Fatalf("subscriberLayers not seeded with resolved default: got %q, want f", got)
+	}
+}
+
+// TestSelectSubscriberLayersKeepsExistingSelection covers that a subscriber who already selected a
+// layer (e.g. via select-layer, or a prior downgrade) keeps receiving it on subsequent calls
+// instead of being reset back to the default.
+func TestSelectSubscriberLayersKeepsExistingSelection(t *testing.T) {
+	room := &roomCollection{
+		trackLocals: map[string]*localTrackData{
+			trackLocalKey("stream-1", "f"): newTestTrackLocalData(t, "stream-1", "f"),
+			trackLocalKey("stream-1", "h"): newTestTrackLocalData(t, "stream-1", "h"),
+		},
+		subscriberLayers: map[string]map[string]string{
+			"peer-1": {"stream-1": "h"},
+		},
+	}
+
+	wanted := selectSubscriberLayers(room, "peer-1")
+
+	if ltd := wanted["stream-1"]; ltd.rid != "h" {
+		t.Fatalf("selectSubscriberLayers = %q; want the subscriber's existing selection h preserved", ltd.rid)
+	}
+}
+
+// TestSelectSubscriberLayersNonSimulcast covers the single-layer case (plain audio, or a
+// non-simulcast video publish), which must be forwarded regardless of subscriberLayers.
+func TestSelectSubscriberLayersNonSimulcast(t *testing.T) {
+	room := &roomCollection{
+		trackLocals: map[string]*localTrackData{
+			trackLocalKey("audio-1", ""): newTestTrackLocalData(t, "audio-1", ""),
+		},
+		subscriberLayers: map[string]map[string]string{},
+	}
+
+	wanted := selectSubscriberLayers(room, "peer-1")
+
+	if ltd, ok := wanted["audio-1"]; !ok || ltd.rid != "" {
+		t.Fatalf("selectSubscriberLayers for a non-simulcast stream = %+v; want the single available layer", wanted)
+	}
+}